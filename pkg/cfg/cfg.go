@@ -17,7 +17,10 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/mitchellh/mapstructure"
 
@@ -25,6 +28,9 @@ import (
 	securerandom "github.com/theckman/go-securerandom"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+
+	"github.com/vouch/vouch-proxy/pkg/policy"
+	"github.com/vouch/vouch-proxy/pkg/secrets"
 )
 
 // Config vouch jwt cookie configuration
@@ -38,10 +44,15 @@ type Config struct {
 	AllowAllUsers bool     `mapstructure:"allowAllUsers"`
 	PublicAccess  bool     `mapstructure:"publicAccess"`
 	JWT           struct {
-		MaxAge   int    `mapstructure:"maxAge"` // in minutes
-		Issuer   string `mapstructure:"issuer"`
-		Secret   string `mapstructure:"secret"`
-		Compress bool   `mapstructure:"compress"`
+		MaxAge int    `mapstructure:"maxAge"` // in minutes
+		Issuer string `mapstructure:"issuer"`
+		Secret string `mapstructure:"secret"`
+		// PreviousSecret, when set, is accepted by the JWT verifier alongside
+		// Secret, so cookies signed with the old key stay valid during a key
+		// rotation rather than logging everyone out mid-rotation. It is read
+		// from config only; secrets renewal neither sets nor clears it.
+		PreviousSecret string `mapstructure:"previousSecret"`
+		Compress       bool   `mapstructure:"compress"`
 	}
 	Cookie struct {
 		Name     string `mapstructure:"name"`
@@ -62,6 +73,7 @@ type Config struct {
 		Claims        []string          `mapstructure:"claims"`
 		AccessToken   string            `mapstructure:"accesstoken"`
 		IDToken       string            `mapstructure:"idtoken"`
+		PolicyRule    string            `mapstructure:"policyrule"` // debug header naming the policy rule /validate matched
 		ClaimsCleaned map[string]string // the rawClaim is mapped to the actual claims header
 	}
 	Session struct {
@@ -72,6 +84,106 @@ type Config struct {
 	TestURLs           []string `mapstructure:"test_urls"`
 	Testing            bool     `mapstructure:"testing"`
 	LogoutRedirectURLs []string `mapstructure:"post_logout_redirect_uris"`
+
+	// Redirect controls the HTTP status codes vouch uses for its two
+	// bounces and which post-login return URLs it will honor.
+	Redirect struct {
+		// LoginCode is used for the initial /login bounce to the IdP.
+		// CallbackCode is used for the post-callback bounce back to the
+		// originally requested URL. Both default to 302 Found when unset.
+		LoginCode    int `mapstructure:"loginCode"`
+		CallbackCode int `mapstructure:"callbackCode"`
+
+		// AllowedURIs is enforced against both the pre-auth `url=` query
+		// parameter and LogoutRedirectURLs: exact URIs, or a
+		// "https://*.example.com/*" glob. Empty means redirect targets
+		// fall back to the existing Domains check instead of being
+		// allowed unconditionally.
+		AllowedURIs []string `mapstructure:"allowed_uris"`
+
+		// StripQueryParams lists query parameters to drop from a return URL
+		// before it's echoed back in a redirect header, eg to keep `state`
+		// or tokens out of downstream referrers.
+		StripQueryParams []string `mapstructure:"strip_query_params"`
+	} `mapstructure:"redirect"`
+
+	// AuthBackend selects how vouch authenticates users: "oauth" (the
+	// default) redirects to an OIDC/OAuth2 IdP; "ldap" binds against a
+	// directory instead, for environments with no OIDC IdP.
+	AuthBackend string `mapstructure:"auth_backend"`
+
+	// LDAP configures the ldap auth backend; only read when
+	// AuthBackend == "ldap".
+	LDAP struct {
+		URL                string            `mapstructure:"url"`
+		BindDN             string            `mapstructure:"bind_dn"`
+		BindPassword       string            `mapstructure:"bind_password"`
+		UserSearchBase     string            `mapstructure:"user_search_base"`
+		UserFilter         string            `mapstructure:"user_filter"`
+		GroupSearchBase    string            `mapstructure:"group_search_base"`
+		GroupFilter        string            `mapstructure:"group_filter"`
+		Attributes         map[string]string `mapstructure:"attributes"` // vouch claim name -> ldap attribute name
+		StartTLS           bool              `mapstructure:"starttls"`
+		InsecureSkipVerify bool              `mapstructure:"insecure_skip_verify"`
+		CACert             string            `mapstructure:"ca_cert"`
+
+		// Admins lists the usernames or emails allowed to call
+		// /ldap/ping, which dials and binds to an attacker-suppliable
+		// url/bind_dn/bind_password - a regular authenticated user must
+		// not be able to use it as an SSRF primitive.
+		Admins []string `mapstructure:"admins"`
+	} `mapstructure:"ldap"`
+
+	// Policy holds ordered allow/deny rules evaluated first-match-wins by
+	// /validate; see policy.Engine. When unset, compilePolicy lowers
+	// WhiteList/TeamWhiteList/Domains/AllowAllUsers into an equivalent
+	// allow-rule list so existing configs keep working unchanged.
+	Policy struct {
+		Allow []policy.RuleConfig `mapstructure:"allow"`
+		Deny  []policy.RuleConfig `mapstructure:"deny"`
+	} `mapstructure:"policy"`
+
+	// DeviceFlow enables RFC 8628 (OAuth 2.0 Device Authorization Grant)
+	// for CLI tools, TVs and other devices that can't receive a browser
+	// redirect themselves.
+	DeviceFlow struct {
+		Enabled bool `mapstructure:"enabled"`
+		// Endpoint overrides the provider's device authorization endpoint;
+		// when empty it falls back to deviceEndpointDefaults[GenOAuth.Provider].
+		Endpoint string `mapstructure:"endpoint"`
+		// PollIntervalDefault is used when the IdP's device authorization
+		// response omits "interval" (seconds).
+		PollIntervalDefault int `mapstructure:"pollIntervalDefault"`
+		// MaxPollSeconds bounds how long /device/poll keeps honoring
+		// authorization_pending before the device code is treated as expired.
+		MaxPollSeconds int `mapstructure:"maxPollSeconds"`
+	} `mapstructure:"device_flow"`
+
+	// Secrets configures where vouch.jwt.secret, vouch.session.key and
+	// oauth.client_secret are sourced from. The zero value (backend "" or
+	// "file") preserves the historical config/secret file behavior.
+	Secrets struct {
+		Backend   string `mapstructure:"backend"` // file (default) | vault
+		Address   string `mapstructure:"address"`
+		Namespace string `mapstructure:"namespace"`
+		Mount     string `mapstructure:"mount"`
+		Path      string `mapstructure:"path"`
+		// KVVersion overrides the auto-detected Vault KV engine version (1
+		// or 2). Leave at 0 to auto-detect.
+		KVVersion int `mapstructure:"kvVersion"`
+		// RenewSeconds controls how often a leased secret (eg from Vault) is
+		// re-fetched and its lease renewed. Zero disables background renewal.
+		// Renewal refreshes only the provider's own cache: vouch.jwt.secret
+		// and vouch.session.key are re-resolved only on a config reload.
+		RenewSeconds int `mapstructure:"renewSeconds"`
+		Auth         struct {
+			Method   string `mapstructure:"method"` // token | approle | kubernetes
+			Token    string `mapstructure:"token"`
+			RoleID   string `mapstructure:"role_id"`
+			SecretID string `mapstructure:"secret_id"`
+			Role     string `mapstructure:"role"`
+		} `mapstructure:"auth"`
+	} `mapstructure:"secrets"`
 }
 
 type branding struct {
@@ -95,6 +207,11 @@ var (
 
 	secretFile string
 
+	// secretsProvider is the provider backing the live config, as built by
+	// configureSecrets and published by Configure/reloadConfig; it stays
+	// nil when configureSecrets builds none.
+	secretsProvider secrets.Provider
+
 	// CmdLine command line arguments
 	CmdLine = &cmdLineFlags{
 		IsHealthCheck: flag.Bool("healthcheck", false, "invoke healthcheck (check process return value)"),
@@ -105,8 +222,20 @@ var (
 		logTest:  flag.Bool("logtest", false, "print a series of log messages and exit (used for testing)"),
 	}
 
-	// Cfg the main exported config variable
+	// Cfg the main exported config variable. Callers that need to observe a
+	// live config reload (see watchConfig) should migrate to Current()
+	// instead, which reads the same value through an atomic.Pointer.
 	Cfg = &Config{}
+
+	// currentCfg backs Current(); watchConfig keeps it in sync with Cfg.
+	currentCfg atomic.Pointer[Config]
+
+	// currentPolicyEngine backs CurrentPolicyEngine(); like currentCfg, it
+	// is only ever written by Configure()/reloadConfig, after the whole
+	// reload pipeline has validated, and read by everything else through
+	// the accessor below so a reload in progress is never observed.
+	currentPolicyEngine atomic.Pointer[policy.Engine]
+
 	// IsHealthCheck see main.go
 	IsHealthCheck = false
 )
@@ -143,10 +272,22 @@ func Configure() {
 	parseConfig()
 	Logging.configure()
 	setDefaults()
+	provider, err := configureSecrets()
+	if err != nil {
+		log.Panic(err)
+	}
+	secretsProvider = provider
+	engine, err := compilePolicy()
+	if err != nil {
+		log.Panic(err)
+	}
+	currentPolicyEngine.Store(engine)
 	cleanClaimsHeaders()
 	if *CmdLine.port != -1 {
 		Cfg.Port = *CmdLine.port
 	}
+	currentCfg.Store(Cfg)
+	watchConfig()
 
 }
 
@@ -185,6 +326,14 @@ func InitForTestPurposes() {
 	InitForTestPurposesWithProvider("")
 }
 
+// PublishForTest stores Cfg into currentCfg so Current() reflects
+// whatever a test just set on Cfg directly - for packages outside cfg
+// whose tests need to mutate config and then exercise Current()-reading
+// code, without a full InitForTestPurposes()/Configure() round trip.
+func PublishForTest() {
+	currentCfg.Store(Cfg)
+}
+
 // InitForTestPurposesWithProvider just for testing
 func InitForTestPurposesWithProvider(provider string) {
 	Cfg = &Config{} // clear it out since we're called multiple times from subsequent tests
@@ -215,6 +364,11 @@ func InitForTestPurposesWithProvider(provider string) {
 	}
 	cleanClaimsHeaders()
 
+	// publish for Current(), same as Configure() does, so code under test
+	// that reads through it (everything added since the live-reload work)
+	// sees a config instead of nil. CurrentPolicyEngine() is not published
+	// here.
+	currentCfg.Store(Cfg)
 }
 
 // parseConfig parse the config file
@@ -301,21 +455,55 @@ func Get(key string) string {
 	return viper.GetString(key)
 }
 
+// Current returns the live *Config, safe to call while watchConfig is
+// swapping it out underneath a running server. New code should prefer
+// this over reading the Cfg package variable directly.
+func Current() *Config {
+	return currentCfg.Load()
+}
+
+// CurrentPolicyEngine returns the live compiled policy.Engine, safe to
+// call while watchConfig is swapping it out underneath a running server.
+// It returns nil until the first successful Configure()/reload.
+func CurrentPolicyEngine() *policy.Engine {
+	return currentPolicyEngine.Load()
+}
+
+// requiredOptionsFor returns the dot-path config options that must be set
+// for the configured auth backend: RequiredOptions for the default oauth
+// backend, or the ldap connection basics when vouch.auth_backend is ldap.
+func requiredOptionsFor(backend string) []string {
+	if backend == "ldap" {
+		return []string{Branding.LCName + ".ldap.url", Branding.LCName + ".ldap.bind_dn", Branding.LCName + ".ldap.user_search_base", Branding.LCName + ".ldap.user_filter"}
+	}
+	return RequiredOptions
+}
+
 // basicTest just a quick sanity check to see if the config is sound
 func basicTest() error {
 
-	// check oauth config
-	if err := oauthBasicTest(); err != nil {
-		return err
+	if Cfg.AuthBackend == "ldap" {
+		if !viper.IsSet(Branding.LCName + ".ldap") {
+			return errors.New("configuration error: " + Branding.LCName + ".auth_backend is ldap but no " + Branding.LCName + ".ldap block is set")
+		}
+	} else {
+		// check oauth config
+		if err := oauthBasicTest(); err != nil {
+			return err
+		}
 	}
 
-	for _, opt := range RequiredOptions {
+	for _, opt := range requiredOptionsFor(Cfg.AuthBackend) {
 		if !viper.IsSet(opt) {
 			return errors.New("configuration error: required configuration option " + opt + " is not set")
 		}
 	}
-	// Domains is required _unless_ Cfg.AllowAllUsers is set
-	if !viper.IsSet(Branding.LCName+".allowAllUsers") && !viper.IsSet(Branding.LCName+".domains") {
+	// Domains is required _unless_ Cfg.AllowAllUsers is set, or the operator
+	// configured vouch.policy.allow/deny instead - a policy-only config
+	// (eg per-host rules with no domain restriction) has its own way of
+	// deciding who gets in and doesn't need the legacy fields at all.
+	if !viper.IsSet(Branding.LCName+".allowAllUsers") && !viper.IsSet(Branding.LCName+".domains") &&
+		len(Cfg.Policy.Allow)+len(Cfg.Policy.Deny) == 0 {
 		return fmt.Errorf("configuration error: either one of %s or %s needs to be set (but not both)", Branding.LCName+".domains", Branding.LCName+".allowAllUsers")
 	}
 
@@ -344,9 +532,55 @@ func basicTest() error {
 	if Cfg.Cookie.MaxAge > Cfg.JWT.MaxAge {
 		return fmt.Errorf("configuration error: Cookie maxAge (%d) cannot be larger than the JWT maxAge (%d)", Cfg.Cookie.MaxAge, Cfg.JWT.MaxAge)
 	}
+
+	// vouch.policy and the legacy flat fields describe the same thing two
+	// ways; allow using one or the other but not both at once, since
+	// there's no sound way to merge "allow everyone" with a deny rule.
+	// compilePolicy silently drops Domains/WhiteList/TeamWhiteList/
+	// AllowAllUsers whenever policy.Allow/Deny is set, so letting both
+	// through here would mean the legacy fields look configured but are
+	// never actually applied.
+	if len(Cfg.Policy.Allow)+len(Cfg.Policy.Deny) > 0 && viper.IsSet(Branding.LCName+".policy") &&
+		(viper.IsSet(Branding.LCName+".whitelist") || viper.IsSet(Branding.LCName+".teamWhitelist") ||
+			viper.IsSet(Branding.LCName+".allowAllUsers") || viper.IsSet(Branding.LCName+".domains")) {
+		return errors.New("configuration error: " + Branding.LCName + ".policy cannot be set alongside domains, whitelist, teamWhitelist or allowAllUsers; migrate them into policy.allow")
+	}
+
+	if err := validateRedirectCode(Cfg.Redirect.LoginCode, "redirect.loginCode"); err != nil {
+		return err
+	}
+	if err := validateRedirectCode(Cfg.Redirect.CallbackCode, "redirect.callbackCode"); err != nil {
+		return err
+	}
 	return nil
 }
 
+func validateRedirectCode(code int, name string) error {
+	switch code {
+	case 0, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return nil
+	default:
+		return fmt.Errorf("configuration error: %s must be one of 302, 303, 307 or 308 (got %d)", Branding.LCName+"."+name, code)
+	}
+}
+
+// compilePolicy lowers the legacy flat allow-list fields into policy rules
+// (when vouch.policy itself is unset) and compiles the result into an
+// Engine. It deliberately does not publish to currentPolicyEngine itself -
+// a reload that compiles fine here can still fail a later step in the
+// validation pipeline, and the caller shouldn't leave currentPolicyEngine
+// pointing at a config that never actually took effect. Callers publish
+// the returned Engine via CurrentPolicyEngine's backing store once they
+// know the whole pipeline succeeded.
+func compilePolicy() (*policy.Engine, error) {
+	allow := Cfg.Policy.Allow
+	if len(allow) == 0 && len(Cfg.Policy.Deny) == 0 {
+		allow = policy.LowerLegacy(Cfg.Domains, Cfg.WhiteList, Cfg.TeamWhiteList, Cfg.AllowAllUsers)
+	}
+
+	return policy.Compile(allow, Cfg.Policy.Deny)
+}
+
 // setDefaults set default options for most items
 func setDefaults() {
 
@@ -359,6 +593,13 @@ func setDefaults() {
 	}
 	log.Debugf("setDefaults from .defaults.yml %+v", Cfg)
 
+	if Cfg.AuthBackend == "" {
+		Cfg.AuthBackend = "oauth"
+	}
+	if Cfg.Headers.PolicyRule == "" {
+		Cfg.Headers.PolicyRule = "X-Vouch-Policy-Rule"
+	}
+
 	// bare minimum for healthcheck achieved
 	if *CmdLine.IsHealthCheck {
 		return
@@ -366,6 +607,94 @@ func setDefaults() {
 
 }
 
+// secretPlaceholder matches `${secret:key}` anywhere in a config value
+var secretPlaceholder = regexp.MustCompile(`\$\{secret:([^}]+)\}`)
+
+// configureSecrets builds the configured secrets.Provider (if any) and
+// resolves `${secret:key}` placeholders in vouch.jwt.secret,
+// vouch.session.key and oauth.client_secret before basicTest runs. It is
+// a no-op (nil provider, nil error) when vouch.secrets.backend is unset
+// and none of those three fields holds a placeholder, preserving the
+// plain config/secret file and env var behavior.
+//
+// It deliberately does not assign the package-level secretsProvider
+// itself, and does not close whatever provider is currently live -
+// a reload that builds a provider here can still fail a later step in
+// the validation pipeline, and closing the old provider before knowing
+// that would tear down the one actually backing the config still being
+// served. Callers publish (and retire the previous provider) once the
+// whole pipeline has succeeded.
+func configureSecrets() (secrets.Provider, error) {
+	if Cfg.Secrets.Backend == "" && !secretPlaceholder.MatchString(Cfg.JWT.Secret) &&
+		!secretPlaceholder.MatchString(Cfg.Session.Key) && !secretPlaceholder.MatchString(GenOAuth.ClientSecret) {
+		return nil, nil
+	}
+
+	secrets.SetLogger(log)
+
+	provider, err := secrets.NewProvider(Cfg.Secrets.Backend, secrets.Options{
+		FilePath: secretFile,
+		Vault: secrets.VaultOptions{
+			Address:       Cfg.Secrets.Address,
+			Namespace:     Cfg.Secrets.Namespace,
+			Mount:         Cfg.Secrets.Mount,
+			Path:          Cfg.Secrets.Path,
+			KVVersion:     Cfg.Secrets.KVVersion,
+			RenewInterval: time.Duration(Cfg.Secrets.RenewSeconds) * time.Second,
+			Auth: secrets.VaultAuth{
+				Method:   Cfg.Secrets.Auth.Method,
+				Token:    Cfg.Secrets.Auth.Token,
+				RoleID:   Cfg.Secrets.Auth.RoleID,
+				SecretID: Cfg.Secrets.Auth.SecretID,
+				Role:     Cfg.Secrets.Auth.Role,
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("configuring secrets provider: %w", err)
+	}
+
+	if Cfg.JWT.Secret, err = resolveSecret(provider, Cfg.JWT.Secret, "jwt_secret", "vouch.jwt.secret"); err != nil {
+		provider.Close()
+		return nil, err
+	}
+	if Cfg.Session.Key, err = resolveSecret(provider, Cfg.Session.Key, "session_key", "vouch.session.key"); err != nil {
+		provider.Close()
+		return nil, err
+	}
+	if GenOAuth.ClientSecret, err = resolveSecret(provider, GenOAuth.ClientSecret, "client_secret", "oauth.client_secret"); err != nil {
+		provider.Close()
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+// resolveSecret fetches a value through provider when either:
+//   - value contains a `${secret:key}` placeholder, in which case that key
+//     is fetched, or
+//   - value is empty, in which case defaultKey is fetched - this is what
+//     lets an operator simply omit vouch.jwt.secret et al entirely and
+//     have it sourced from vouch.secrets rather than spelling out a
+//     placeholder for every field.
+//
+// A non-empty value with no placeholder passes through unchanged, so
+// operators can still set any of these fields directly.
+func resolveSecret(provider secrets.Provider, value, defaultKey, name string) (string, error) {
+	key := defaultKey
+	if m := secretPlaceholder.FindStringSubmatch(value); m != nil {
+		key = m[1]
+	} else if value != "" {
+		return value, nil
+	}
+
+	resolved, err := provider.Fetch(key)
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %w", name, err)
+	}
+	return resolved, nil
+}
+
 func claimToHeader(claim string) (string, error) {
 	was := claim
 
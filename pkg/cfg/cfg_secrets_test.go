@@ -0,0 +1,69 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import "testing"
+
+type fakeProvider map[string]string
+
+func (f fakeProvider) Fetch(key string) (string, error) {
+	v, ok := f[key]
+	if !ok {
+		return "", errNotFound
+	}
+	return v, nil
+}
+
+func (f fakeProvider) Close() {}
+
+var errNotFound = &fetchError{"not found"}
+
+type fetchError struct{ msg string }
+
+func (e *fetchError) Error() string { return e.msg }
+
+func TestResolveSecretPassesThroughPlainValue(t *testing.T) {
+	got, err := resolveSecret(fakeProvider{}, "plain-value", "default-key", "vouch.jwt.secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != "plain-value" {
+		t.Errorf("got %q, want %q", got, "plain-value")
+	}
+}
+
+func TestResolveSecretResolvesPlaceholder(t *testing.T) {
+	provider := fakeProvider{"my_key": "resolved-value"}
+	got, err := resolveSecret(provider, "${secret:my_key}", "default-key", "vouch.jwt.secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != "resolved-value" {
+		t.Errorf("got %q, want %q", got, "resolved-value")
+	}
+}
+
+func TestResolveSecretResolvesEmptyValueViaDefaultKey(t *testing.T) {
+	provider := fakeProvider{"default-key": "from-default-key"}
+	got, err := resolveSecret(provider, "", "default-key", "vouch.jwt.secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != "from-default-key" {
+		t.Errorf("got %q, want %q", got, "from-default-key")
+	}
+}
+
+func TestResolveSecretErrorsWhenProviderMisses(t *testing.T) {
+	if _, err := resolveSecret(fakeProvider{}, "${secret:missing}", "default-key", "vouch.jwt.secret"); err == nil {
+		t.Fatal("expected an error for a key the provider doesn't have")
+	}
+}
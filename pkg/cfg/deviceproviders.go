@@ -0,0 +1,31 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+// deviceEndpointDefaults holds the well-known RFC 8628 device authorization
+// endpoint for each provider vouch ships presets for. vouch.device_flow.endpoint
+// overrides these for providers not listed here (eg a generic OIDC IdP).
+var deviceEndpointDefaults = map[string]string{
+	"google": "https://oauth2.googleapis.com/device/code",
+	"azure":  "https://login.microsoftonline.com/organizations/oauth2/v2.0/devicecode",
+}
+
+// DeviceEndpoint returns the device authorization endpoint to use for the
+// configured oauth provider: an explicit vouch.device_flow.endpoint wins,
+// otherwise the provider's well-known default, if any. It reads the live
+// config through Current() since it's called from the request-serving
+// path and must not observe a reload's in-progress shadow config.
+func DeviceEndpoint() string {
+	if endpoint := Current().DeviceFlow.Endpoint; endpoint != "" {
+		return endpoint
+	}
+	return deviceEndpointDefaults[GenOAuth.Provider]
+}
@@ -0,0 +1,107 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// LoginRedirectCode is the status code for the initial /login bounce to
+// the IdP; defaults to the historical 302 Found when unset. It reads the
+// live config through Current(), since it's called from the
+// request-serving path and must not observe a reload's in-progress
+// shadow config.
+func LoginRedirectCode() int {
+	if Current().Redirect.LoginCode == 0 {
+		return http.StatusFound
+	}
+	return Current().Redirect.LoginCode
+}
+
+// CallbackRedirectCode is the status code for the post-callback bounce
+// back to the originally requested URL; defaults to 302 Found when unset.
+func CallbackRedirectCode() int {
+	if Current().Redirect.CallbackCode == 0 {
+		return http.StatusFound
+	}
+	return Current().Redirect.CallbackCode
+}
+
+// IsAllowedRedirectURL reports whether target may be used as a post-login
+// or post-logout return URL. It is enforced against both the pre-auth
+// `url=` query parameter and LogoutRedirectURLs: target is allowed if it
+// exactly matches one of LogoutRedirectURLs, or if it matches
+// vouch.redirect.allowed_uris (exact, or a "https://*.example.com/*"
+// glob). If vouch.redirect.allowed_uris is unset, target falls back to
+// the existing Domains check instead of being allowed unconditionally -
+// a relative target (no host) is always same-origin and allowed, an
+// absolute one must name a host in Domains. Callers should reject rather
+// than silently fall back when this returns false.
+func IsAllowedRedirectURL(target string) bool {
+	c := Current()
+
+	for _, u := range c.LogoutRedirectURLs {
+		if u == target {
+			return true
+		}
+	}
+
+	if allowed := c.Redirect.AllowedURIs; len(allowed) > 0 {
+		for _, a := range allowed {
+			if a == target {
+				return true
+			}
+			if strings.Contains(a, "*") {
+				if ok, err := path.Match(a, target); err == nil && ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	if u.Host == "" {
+		return true
+	}
+	for _, d := range c.Domains {
+		if u.Host == d || strings.HasSuffix(u.Host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// StripTrackingParams removes vouch.redirect.strip_query_params from
+// target before it's echoed back in a redirect header, so params like
+// `state` (or, worse, tokens) don't leak into downstream referrers.
+func StripTrackingParams(target string) string {
+	strip := Current().Redirect.StripQueryParams
+	if len(strip) == 0 {
+		return target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	q := u.Query()
+	for _, p := range strip {
+		q.Del(p)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
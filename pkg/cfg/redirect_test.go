@@ -0,0 +1,124 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"net/http"
+	"testing"
+)
+
+// publishForTest stores Cfg into currentCfg, the same publish step
+// reloadConfig performs, so the Current()-reading helpers under test see it.
+func publishForTest() {
+	currentCfg.Store(Cfg)
+}
+
+func TestLoginRedirectCodeDefault(t *testing.T) {
+	Cfg.Redirect.LoginCode = 0
+	publishForTest()
+	if got := LoginRedirectCode(); got != http.StatusFound {
+		t.Errorf("got %d, want %d", got, http.StatusFound)
+	}
+}
+
+func TestLoginRedirectCodeConfigured(t *testing.T) {
+	Cfg.Redirect.LoginCode = http.StatusTemporaryRedirect
+	defer func() { Cfg.Redirect.LoginCode = 0; publishForTest() }()
+	publishForTest()
+	if got := LoginRedirectCode(); got != http.StatusTemporaryRedirect {
+		t.Errorf("got %d, want %d", got, http.StatusTemporaryRedirect)
+	}
+}
+
+func TestIsAllowedRedirectURLFallsBackToDomains(t *testing.T) {
+	Cfg.Redirect.AllowedURIs = nil
+	Cfg.Domains = []string{"example.com"}
+	defer func() { Cfg.Domains = nil; publishForTest() }()
+	publishForTest()
+
+	if IsAllowedRedirectURL("https://evil.example.com.attacker.net/") {
+		t.Error("expected a host outside Domains to be rejected by default")
+	}
+	if !IsAllowedRedirectURL("https://sso.example.com/dashboard") {
+		t.Error("expected a host matching Domains to be allowed")
+	}
+	if !IsAllowedRedirectURL("/dashboard") {
+		t.Error("expected a relative (same-origin) target to be allowed")
+	}
+}
+
+func TestIsAllowedRedirectURLRejectsByDefaultWithNoDomains(t *testing.T) {
+	Cfg.Redirect.AllowedURIs = nil
+	Cfg.Domains = nil
+	publishForTest()
+
+	if IsAllowedRedirectURL("https://evil.example.com/") {
+		t.Error("expected an absolute URL to be rejected when neither allowed_uris nor domains is set")
+	}
+}
+
+func TestIsAllowedRedirectURLLogoutURLs(t *testing.T) {
+	Cfg.LogoutRedirectURLs = []string{"https://app.example.com/logged-out"}
+	defer func() { Cfg.LogoutRedirectURLs = nil; publishForTest() }()
+	publishForTest()
+
+	if !IsAllowedRedirectURL("https://app.example.com/logged-out") {
+		t.Error("expected an exact LogoutRedirectURLs match to be allowed")
+	}
+	if IsAllowedRedirectURL("https://evil.example.com/") {
+		t.Error("expected a non-matching URL to still be rejected")
+	}
+}
+
+func TestIsAllowedRedirectURLLiteral(t *testing.T) {
+	Cfg.Redirect.AllowedURIs = []string{"/dashboard"}
+	defer func() { Cfg.Redirect.AllowedURIs = nil; publishForTest() }()
+	publishForTest()
+	if !IsAllowedRedirectURL("/dashboard") {
+		t.Error("expected literal match to be allowed")
+	}
+	if IsAllowedRedirectURL("/other") {
+		t.Error("expected non-matching literal to be rejected")
+	}
+}
+
+func TestIsAllowedRedirectURLGlob(t *testing.T) {
+	Cfg.Redirect.AllowedURIs = []string{"/app/*"}
+	defer func() { Cfg.Redirect.AllowedURIs = nil; publishForTest() }()
+	publishForTest()
+	if !IsAllowedRedirectURL("/app/settings") {
+		t.Error("expected glob match to be allowed")
+	}
+	if IsAllowedRedirectURL("/other") {
+		t.Error("expected non-matching path to be rejected")
+	}
+}
+
+func TestStripTrackingParams(t *testing.T) {
+	Cfg.Redirect.StripQueryParams = []string{"state", "token"}
+	defer func() { Cfg.Redirect.StripQueryParams = nil; publishForTest() }()
+	publishForTest()
+
+	got := StripTrackingParams("/app?state=abc&token=xyz&keep=1")
+	want := "/app?keep=1"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStripTrackingParamsNoConfig(t *testing.T) {
+	Cfg.Redirect.StripQueryParams = nil
+	publishForTest()
+	target := "/app?state=abc"
+	if got := StripTrackingParams(target); got != target {
+		t.Errorf("got %q, want unchanged %q", got, target)
+	}
+}
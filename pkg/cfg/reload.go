@@ -0,0 +1,159 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// reloadMu serializes reloads: viper's fsnotify callback and our SIGHUP
+// fallback can both fire for the same underlying file change.
+var reloadMu sync.Mutex
+
+// watchConfig wires viper.WatchConfig so that changes to the config file
+// (eg an IdP secret rotation, or an updated claim mapping) take effect
+// without a container restart. A SIGHUP handler is also registered as a
+// fallback for environments - notably a ConfigMap bind-mount - where
+// fsnotify can't reliably observe the underlying file change.
+func watchConfig() {
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		log.Infof("%s config file changed (%s), reloading", Branding.CcName, e.Name)
+		reloadConfig()
+	})
+	viper.WatchConfig()
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			log.Infof("%s received SIGHUP, reloading config", Branding.CcName)
+			reloadConfig()
+		}
+	}()
+}
+
+// reloadConfig rebuilds a fresh *Config through the same
+// parseConfig/setDefaults/configureSecrets/compilePolicy/cleanClaimsHeaders/
+// basicTest pipeline that Configure and ValidateConfiguration run at
+// startup, and only publishes it - via
+// currentCfg, currentPolicyEngine and secretsProvider - once every step
+// has validated. Request handlers and the other packages in this series
+// read the live config through Current(), never through the Cfg
+// package variable directly, so they never observe a half-built shadow:
+// Cfg itself is reused as the rebuild's scratch space (every pipeline
+// step already reads and writes it directly) but it's only ever touched
+// here, under reloadMu, and nothing outside this function is allowed to
+// read it.
+func reloadConfig() {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	previous := Cfg
+	previousOauthHash := oauthRelevantHash(previous)
+
+	shadow := &Config{}
+	Cfg = shadow
+
+	rollback := func(err error) {
+		log.Errorf("config reload failed, keeping previous configuration: %s", err)
+		Cfg = previous
+	}
+
+	parseConfig()
+	setDefaults()
+
+	provider, err := configureSecrets()
+	if err != nil {
+		rollback(err)
+		return
+	}
+	engine, err := compilePolicy()
+	if err != nil {
+		if provider != nil {
+			provider.Close()
+		}
+		rollback(err)
+		return
+	}
+	if err := cleanClaimsHeaders(); err != nil {
+		if provider != nil {
+			provider.Close()
+		}
+		rollback(err)
+		return
+	}
+	if err := basicTest(); err != nil {
+		if provider != nil {
+			provider.Close()
+		}
+		rollback(err)
+		return
+	}
+
+	logConfigDiff(previous, Cfg)
+
+	if oauthRelevantHash(Cfg) != previousOauthHash {
+		log.Info("oauth-relevant configuration changed, rebuilding oauth client")
+		if err := configureOauth(); err != nil {
+			log.Errorf("rebuilding oauth client after reload: %s", err)
+		}
+	}
+
+	// everything validated: retire the previous provider/engine and
+	// publish the new config as one atomic step.
+	if provider != nil {
+		if secretsProvider != nil {
+			secretsProvider.Close()
+		}
+		secretsProvider = provider
+	}
+	currentPolicyEngine.Store(engine)
+	currentCfg.Store(Cfg)
+}
+
+// oauthRelevantHash hashes the sub-tree that influences the OAuth client
+// and any cached JWKS, so reloadConfig only rebuilds them when one of
+// those inputs actually changed.
+func oauthRelevantHash(c *Config) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%+v|%+v", GenOAuth, c.JWT)))
+	return fmt.Sprintf("%x", h)
+}
+
+// logConfigDiff logs the names of the top-level Config fields that
+// changed across a reload. It deliberately logs field names, not values,
+// since several of them (JWT.Secret, Session.Key) are secrets.
+func logConfigDiff(previous, next *Config) {
+	pv := reflect.ValueOf(*previous)
+	nv := reflect.ValueOf(*next)
+	t := pv.Type()
+
+	var changed []string
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if !reflect.DeepEqual(pv.Field(i).Interface(), nv.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) == 0 {
+		log.Info("config reloaded, no effective changes")
+		return
+	}
+	log.Infof("config reloaded, changed sections: %v", changed)
+}
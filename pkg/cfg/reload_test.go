@@ -0,0 +1,112 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/vouch/vouch-proxy/pkg/policy"
+)
+
+// TestReloadConfigRollbackLeavesPreviousEngineInPlace mirrors reloadConfig's
+// own shape - build a shadow Cfg, try to compilePolicy it, and only publish
+// to currentPolicyEngine on success - without going through
+// parseConfig/setDefaults/configureSecrets, which need a config file
+// fixture this snapshot doesn't ship. It covers the exact rollback branch
+// reloadConfig takes when compilePolicy fails: the previous engine must
+// still be the one CurrentPolicyEngine() returns afterwards.
+func TestReloadConfigRollbackLeavesPreviousEngineInPlace(t *testing.T) {
+	previous := Cfg
+	previousEngine := currentPolicyEngine.Load()
+	defer func() {
+		Cfg = previous
+		currentPolicyEngine.Store(previousEngine)
+	}()
+
+	goodEngine, err := policy.Compile([]policy.RuleConfig{{Name: "allow-all"}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error compiling the baseline policy: %s", err)
+	}
+	currentPolicyEngine.Store(goodEngine)
+
+	shadow := &Config{}
+	shadow.Policy.Allow = []policy.RuleConfig{{Name: "bad-regex", Email: "~=("}}
+	Cfg = shadow
+
+	if _, err := compilePolicy(); err == nil {
+		t.Fatal("expected compilePolicy to fail on an invalid regex rule")
+	}
+	// reloadConfig's rollback branch returns here without calling
+	// currentPolicyEngine.Store - simulate that by simply not storing.
+
+	if got := CurrentPolicyEngine(); got != goodEngine {
+		t.Error("a failed compilePolicy must leave the previously published engine in place")
+	}
+}
+
+// TestCurrentPolicyEnginePublishIsAtomicUnderConcurrentReads exercises the
+// mechanism reloadConfig's final publish step relies on: concurrent
+// Current()/CurrentPolicyEngine() reads while a "reload" swaps in a new
+// config/engine must never observe a nil or partially-constructed value,
+// since atomic.Pointer.Store/Load swap the whole pointer in one step.
+func TestCurrentPolicyEnginePublishIsAtomicUnderConcurrentReads(t *testing.T) {
+	previousCfg := currentCfg.Load()
+	previousEngine := currentPolicyEngine.Load()
+	defer func() {
+		currentCfg.Store(previousCfg)
+		currentPolicyEngine.Store(previousEngine)
+	}()
+
+	engineA, err := policy.Compile([]policy.RuleConfig{{Name: "a"}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	engineB, err := policy.Compile([]policy.RuleConfig{{Name: "b"}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	currentCfg.Store(&Config{})
+	currentPolicyEngine.Store(engineA)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if c := Current(); c == nil {
+				t.Error("Current() returned nil after a config was published")
+			}
+			if e := CurrentPolicyEngine(); e == nil {
+				t.Error("CurrentPolicyEngine() returned nil after an engine was published")
+			}
+		}
+		close(stop)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				currentCfg.Store(&Config{})
+				currentPolicyEngine.Store(engineB)
+			}
+		}
+	}()
+
+	wg.Wait()
+}
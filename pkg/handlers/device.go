@@ -0,0 +1,256 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/policy"
+)
+
+// deviceSession tracks the server-side polling state for one in-flight
+// device authorization, keyed by device_code. CLIs and IoT devices never
+// see device_code themselves beyond the initial response.
+type deviceSession struct {
+	deviceCode string
+	interval   time.Duration
+	expiresAt  time.Time
+	clientIP   string
+}
+
+var (
+	deviceSessionsMu sync.Mutex
+	deviceSessions   = map[string]*deviceSession{}
+)
+
+// deviceStartResponse is returned by /device/start per RFC 8628 section 3.2
+type deviceStartResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// DeviceStart calls the IdP's device authorization endpoint and relays its
+// response to the caller, so a CLI or headless device can present
+// verification_uri/user_code to whoever is holding the keyboard.
+func DeviceStart(w http.ResponseWriter, r *http.Request) {
+	current := cfg.Current()
+	if !current.DeviceFlow.Enabled {
+		http.Error(w, "device flow is not enabled", http.StatusNotFound)
+		return
+	}
+
+	endpoint := cfg.DeviceEndpoint()
+	if endpoint == "" {
+		log.Error("vouch.device_flow.enabled is true but no device authorization endpoint is configured")
+		http.Error(w, "device flow is misconfigured", http.StatusInternalServerError)
+		return
+	}
+
+	form := url.Values{
+		"client_id": {cfg.GenOAuth.ClientID},
+		"scope":     {joinScopes(cfg.GenOAuth.Scopes)},
+	}
+	resp, err := http.PostForm(endpoint, form)
+	if err != nil {
+		log.Errorf("device authorization request to %s failed: %s", endpoint, err)
+		http.Error(w, "upstream device authorization request failed", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	var body deviceStartResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		log.Errorf("decoding device authorization response: %s", err)
+		http.Error(w, "malformed upstream device authorization response", http.StatusBadGateway)
+		return
+	}
+
+	interval := body.Interval
+	if interval <= 0 {
+		interval = current.DeviceFlow.PollIntervalDefault
+		if interval <= 0 {
+			interval = 5
+		}
+	}
+	maxPoll := current.DeviceFlow.MaxPollSeconds
+	if maxPoll <= 0 {
+		maxPoll = body.ExpiresIn
+	}
+
+	deviceSessionsMu.Lock()
+	deviceSessions[body.DeviceCode] = &deviceSession{
+		deviceCode: body.DeviceCode,
+		interval:   time.Duration(interval) * time.Second,
+		expiresAt:  time.Now().Add(time.Duration(maxPoll) * time.Second),
+		clientIP:   r.RemoteAddr,
+	}
+	deviceSessionsMu.Unlock()
+
+	RenderJSON(w, http.StatusOK, body)
+}
+
+// devicePollRequest is what the CLI sends back to ask "has the user
+// approved yet?"
+type devicePollRequest struct {
+	DeviceCode string `json:"device_code"`
+}
+
+// devicePollResponse carries the minted vouch JWT once the grant
+// completes, so a CLI can store it and send it as `Authorization: Bearer`.
+type devicePollResponse struct {
+	Token string `json:"token,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// oauthErrorResponse is the RFC 6749/8628 token endpoint error body
+type oauthErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// DevicePoll polls the IdP token endpoint on the device's behalf with
+// grant_type=urn:ietf:params:oauth:grant-type:device_code, honoring
+// authorization_pending, slow_down, access_denied and expired_token. On
+// slow_down it doubles the session's stored interval; that interval is not
+// used to pace or reject later polls and is not returned to the client.
+func DevicePoll(w http.ResponseWriter, r *http.Request) {
+	if !cfg.Current().DeviceFlow.Enabled {
+		http.Error(w, "device flow is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req devicePollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "malformed request body", http.StatusBadRequest)
+		return
+	}
+
+	deviceSessionsMu.Lock()
+	sess, ok := deviceSessions[req.DeviceCode]
+	deviceSessionsMu.Unlock()
+	if !ok {
+		RenderJSON(w, http.StatusBadRequest, devicePollResponse{Error: "expired_token"})
+		return
+	}
+	if time.Now().After(sess.expiresAt) {
+		deviceSessionsMu.Lock()
+		delete(deviceSessions, req.DeviceCode)
+		deviceSessionsMu.Unlock()
+		RenderJSON(w, http.StatusBadRequest, devicePollResponse{Error: "expired_token"})
+		return
+	}
+
+	form := url.Values{
+		"client_id":     {cfg.GenOAuth.ClientID},
+		"client_secret": {cfg.GenOAuth.ClientSecret},
+		"device_code":   {req.DeviceCode},
+		"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+	}
+	user, oauthErr, err := exchangeDeviceCode(form)
+	switch {
+	case err != nil:
+		log.Errorf("device code token exchange failed: %s", err)
+		http.Error(w, "upstream token request failed", http.StatusBadGateway)
+		return
+	case oauthErr == "slow_down":
+		sess.interval *= 2
+		RenderJSON(w, http.StatusOK, devicePollResponse{Error: oauthErr})
+		return
+	case oauthErr == "authorization_pending":
+		RenderJSON(w, http.StatusOK, devicePollResponse{Error: oauthErr})
+		return
+	case oauthErr == "access_denied", oauthErr == "expired_token":
+		deviceSessionsMu.Lock()
+		delete(deviceSessions, req.DeviceCode)
+		deviceSessionsMu.Unlock()
+		RenderJSON(w, http.StatusBadRequest, devicePollResponse{Error: oauthErr})
+		return
+	case oauthErr != "":
+		deviceSessionsMu.Lock()
+		delete(deviceSessions, req.DeviceCode)
+		deviceSessionsMu.Unlock()
+		RenderJSON(w, http.StatusBadRequest, devicePollResponse{Error: oauthErr})
+		return
+	}
+
+	deviceSessionsMu.Lock()
+	delete(deviceSessions, req.DeviceCode)
+	deviceSessionsMu.Unlock()
+
+	if decision, rule := Authorize(user, r); decision != policy.Allow {
+		log.Infof("device flow: denying %s (matched rule %q)", user.GetEmail(), rule)
+		RenderJSON(w, http.StatusForbidden, devicePollResponse{Error: "access_denied"})
+		return
+	}
+
+	token, err := jwtmanager.CreateUserTokenString(user)
+	if err != nil {
+		log.Errorf("minting vouch jwt for device flow user: %s", err)
+		http.Error(w, "failed to mint token", http.StatusInternalServerError)
+		return
+	}
+	RenderJSON(w, http.StatusOK, devicePollResponse{Token: token})
+}
+
+// exchangeDeviceCode posts form to the IdP token endpoint and either
+// returns the authenticated user, the OAuth error code from the response
+// body (eg "authorization_pending"), or a transport-level error.
+func exchangeDeviceCode(form url.Values) (jwtmanager.User, string, error) {
+	var user jwtmanager.User
+
+	resp, err := http.PostForm(cfg.GenOAuth.Endpoint.TokenURL, form)
+	if err != nil {
+		return user, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var oe oauthErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&oe); err != nil {
+			return user, "", errors.New("malformed oauth error response")
+		}
+		return user, oe.Error, nil
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return user, "", err
+	}
+
+	if err := user.ParseTokenClaims(token.IDToken); err != nil {
+		return user, "", err
+	}
+	return user, "", nil
+}
+
+func joinScopes(scopes []string) string {
+	out := ""
+	for i, s := range scopes {
+		if i > 0 {
+			out += " "
+		}
+		out += s
+	}
+	return out
+}
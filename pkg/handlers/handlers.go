@@ -0,0 +1,38 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+// Package handlers implements the HTTP handlers vouch-proxy registers on
+// its mux: /login, /auth, /validate, and the feature-gated endpoints
+// added alongside them (device flow, ldap).
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+var log *zap.SugaredLogger
+
+// SetLogger lets main wire in the already-configured Vouch logger, rather
+// than this package standing up its own zap instance.
+func SetLogger(l *zap.SugaredLogger) {
+	log = l
+}
+
+// RenderJSON writes v as the JSON response body with the given status code
+func RenderJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("encoding JSON response: %s", err)
+	}
+}
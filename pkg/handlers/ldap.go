@@ -0,0 +1,219 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"path/filepath"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/ldap"
+	"github.com/vouch/vouch-proxy/pkg/policy"
+)
+
+// ldapLoginTemplate reuses the existing templates/ layout - just a plain
+// username/password form posting back to this same handler - rather than
+// inventing a second login look-and-feel for the ldap backend.
+var ldapLoginTemplate = filepath.Join("templates", "ldap_login.tmpl")
+
+// LdapLogin serves the login form on GET, and on POST binds the supplied
+// credentials against the directory, maps the resulting attributes into
+// Cfg.Headers.Claims/ClaimsCleaned exactly like an OAuth claim would be,
+// and mints the standard vouch JWT.
+func LdapLogin(w http.ResponseWriter, r *http.Request) {
+	current := cfg.Current()
+	if current.AuthBackend != "ldap" {
+		http.Error(w, "ldap auth backend is not enabled", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		redirectURL := r.URL.Query().Get("url")
+		if redirectURL != "" && !cfg.IsAllowedRedirectURL(redirectURL) {
+			http.Error(w, "url is not an allowed redirect target", http.StatusBadRequest)
+			return
+		}
+		renderLdapLoginForm(w, "", redirectURL)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "malformed form", http.StatusBadRequest)
+		return
+	}
+	username := r.FormValue("username")
+	password := r.FormValue("password")
+	redirectURL := r.FormValue("url")
+	if redirectURL != "" && !cfg.IsAllowedRedirectURL(redirectURL) {
+		http.Error(w, "url is not an allowed redirect target", http.StatusBadRequest)
+		return
+	}
+
+	client, err := ldapClientFromConfig()
+	if err != nil {
+		log.Errorf("ldap client configuration: %s", err)
+		http.Error(w, "ldap is misconfigured", http.StatusInternalServerError)
+		return
+	}
+
+	entry, err := client.Authenticate(username, password)
+	if err != nil {
+		log.Infof("ldap authentication failed for %s: %s", username, err)
+		renderLdapLoginForm(w, "invalid username or password", redirectURL)
+		return
+	}
+
+	user := jwtmanager.User{
+		Username: entry.Attributes["username"],
+		Email:    entry.Attributes["email"],
+		Groups:   entry.Groups,
+		Claims:   entry.Attributes,
+	}
+	if user.Username == "" {
+		user.Username = entry.DN
+	}
+
+	if decision, rule := Authorize(user, r); decision != policy.Allow {
+		log.Infof("ldap login: denying %s (matched rule %q)", user.Username, rule)
+		renderLdapLoginForm(w, "access denied", redirectURL)
+		return
+	}
+
+	token, err := jwtmanager.CreateUserTokenString(user)
+	if err != nil {
+		log.Errorf("minting vouch jwt for ldap user %s: %s", username, err)
+		http.Error(w, "failed to mint token", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     current.Cookie.Name,
+		Value:    token,
+		Domain:   current.Cookie.Domain,
+		Secure:   current.Cookie.Secure,
+		HttpOnly: current.Cookie.HTTPOnly,
+		MaxAge:   current.Cookie.MaxAge,
+	})
+
+	target := "/"
+	if redirectURL != "" {
+		target = cfg.StripTrackingParams(redirectURL)
+	}
+	http.Redirect(w, r, target, cfg.CallbackRedirectCode())
+}
+
+func renderLdapLoginForm(w http.ResponseWriter, errorMsg, redirectURL string) {
+	tmpl, err := template.ParseFiles(filepath.Join(cfg.RootDir, ldapLoginTemplate))
+	if err != nil {
+		log.Errorf("parsing %s: %s", ldapLoginTemplate, err)
+		http.Error(w, "could not render login form", http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, map[string]string{"Error": errorMsg, "URL": redirectURL}); err != nil {
+		log.Errorf("rendering %s: %s", ldapLoginTemplate, err)
+	}
+}
+
+// ldapPingRequest is the inline connection config POSTed to /ldap/ping,
+// using vouch.ldap's key names for its connection fields, so operators can
+// validate a candidate config before writing it to disk. The group,
+// attributes, insecure_skip_verify and ca_cert settings are not accepted.
+type ldapPingRequest struct {
+	URL            string `json:"url"`
+	BindDN         string `json:"bind_dn"`
+	BindPassword   string `json:"bind_password"`
+	UserSearchBase string `json:"user_search_base"`
+	UserFilter     string `json:"user_filter"`
+	StartTLS       bool   `json:"starttls"`
+}
+
+type ldapPingResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// LdapPing binds and searches with an inline LDAP config and reports
+// whether it succeeded, without touching the running vouch.ldap config.
+// It takes attacker-influenceable url/bind_dn/bind_password and makes the
+// server dial and bind against them, so it is admin-only: the caller must
+// present a valid vouch session AND be listed in vouch.ldap.admins. The
+// general Authorize() check alone is not enough here - that's the same
+// check any ordinary logged-in user passes to reach /validate, and would
+// hand every authenticated user an SSRF/internal-network-probing primitive.
+func LdapPing(w http.ResponseWriter, r *http.Request) {
+	user, err := userFromRequest(r)
+	if err != nil {
+		log.Debugf("ldap ping: no valid vouch token: %s", err)
+		http.Error(w, "no valid vouch cookie or token", http.StatusUnauthorized)
+		return
+	}
+	if !isLdapAdmin(user) {
+		log.Infof("ldap ping: denying %s: not listed in vouch.ldap.admins", user.GetEmail())
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+
+	var req ldapPingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "malformed request body", http.StatusBadRequest)
+		return
+	}
+
+	client, err := ldap.NewClient(ldap.Config{
+		URL:            req.URL,
+		BindDN:         req.BindDN,
+		BindPassword:   req.BindPassword,
+		UserSearchBase: req.UserSearchBase,
+		UserFilter:     req.UserFilter,
+		StartTLS:       req.StartTLS,
+	})
+	if err != nil {
+		RenderJSON(w, http.StatusBadRequest, ldapPingResponse{OK: false, Error: err.Error()})
+		return
+	}
+
+	if err := client.Ping(); err != nil {
+		RenderJSON(w, http.StatusOK, ldapPingResponse{OK: false, Error: err.Error()})
+		return
+	}
+	RenderJSON(w, http.StatusOK, ldapPingResponse{OK: true})
+}
+
+// isLdapAdmin reports whether user's username or email is listed in
+// vouch.ldap.admins, the predicate /ldap/ping is gated on.
+func isLdapAdmin(user jwtmanager.User) bool {
+	for _, admin := range cfg.Current().LDAP.Admins {
+		if admin == user.Username || admin == user.Email {
+			return true
+		}
+	}
+	return false
+}
+
+func ldapClientFromConfig() (*ldap.Client, error) {
+	l := cfg.Current().LDAP
+	return ldap.NewClient(ldap.Config{
+		URL:                l.URL,
+		BindDN:             l.BindDN,
+		BindPassword:       l.BindPassword,
+		UserSearchBase:     l.UserSearchBase,
+		UserFilter:         l.UserFilter,
+		GroupSearchBase:    l.GroupSearchBase,
+		GroupFilter:        l.GroupFilter,
+		Attributes:         l.Attributes,
+		StartTLS:           l.StartTLS,
+		InsecureSkipVerify: l.InsecureSkipVerify,
+		CACert:             l.CACert,
+	})
+}
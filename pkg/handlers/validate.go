@@ -0,0 +1,88 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/policy"
+)
+
+// Validate is nginx's auth_request target: it trusts the vouch session
+// cookie (or an Authorization: Bearer token, for device-flow clients),
+// then runs it through cfg.CurrentPolicyEngine() before letting the
+// request through to the upstream.
+func Validate(w http.ResponseWriter, r *http.Request) {
+	user, err := userFromRequest(r)
+	if err != nil {
+		log.Debugf("validate: no valid vouch token: %s", err)
+		http.Error(w, "no valid vouch cookie or token", http.StatusUnauthorized)
+		return
+	}
+
+	decision, rule := Authorize(user, r)
+	if policyRule := cfg.Current().Headers.PolicyRule; rule != "" && policyRule != "" {
+		w.Header().Set(policyRule, rule)
+	}
+	if decision != policy.Allow {
+		log.Infof("validate: denying %s for %s (matched rule %q)", user.GetEmail(), r.Host, rule)
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Authorize runs user and the inbound request through
+// cfg.CurrentPolicyEngine(), the single source of truth for allow/deny
+// decisions across every auth backend (OAuth cookie, device flow, ldap)
+// and every access path (/validate, /device/poll, the ldap login form).
+func Authorize(user jwtmanager.User, r *http.Request) (policy.Decision, string) {
+	engine := cfg.CurrentPolicyEngine()
+	if engine == nil {
+		return policy.NoMatch, ""
+	}
+	return engine.Evaluate(user, policy.Request{
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		Method:   r.Method,
+		SourceIP: r.RemoteAddr,
+	})
+}
+
+// userFromRequest extracts and verifies the vouch JWT from the request's
+// vouch cookie, falling back to an Authorization: Bearer header for
+// device-flow clients that never receive a cookie.
+func userFromRequest(r *http.Request) (jwtmanager.User, error) {
+	tokenString := ""
+	if c, err := r.Cookie(cfg.Current().Cookie.Name); err == nil {
+		tokenString = c.Value
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		tokenString = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if tokenString == "" {
+		return jwtmanager.User{}, errNoToken
+	}
+
+	user, err := jwtmanager.ParseTokenString(tokenString)
+	if err != nil {
+		return jwtmanager.User{}, err
+	}
+	return *user, nil
+}
+
+var errNoToken = noTokenError{}
+
+type noTokenError struct{}
+
+func (noTokenError) Error() string { return "no vouch cookie or bearer token present" }
@@ -0,0 +1,138 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+// Package jwtmanager mints and verifies the vouch session JWT that gets
+// set as a cookie (or, for the device flow, handed back directly) after a
+// successful login, regardless of which auth backend produced the user.
+package jwtmanager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// User is the authenticated identity vouch mints a JWT for, however it
+// was obtained (OAuth claims, an LDAP entry, ...). It also satisfies
+// policy.User so policy.Engine.Evaluate can run against it directly.
+type User struct {
+	Username string            `json:"username"`
+	Email    string            `json:"email"`
+	Sub      string            `json:"sub"`
+	Groups   []string          `json:"groups"`
+	Claims   map[string]string `json:"claims"`
+}
+
+// GetEmail implements policy.User
+func (u User) GetEmail() string { return u.Email }
+
+// GetSub implements policy.User
+func (u User) GetSub() string { return u.Sub }
+
+// GetGroups implements policy.User
+func (u User) GetGroups() []string { return u.Groups }
+
+// GetClaim implements policy.User
+func (u User) GetClaim(name string) (string, bool) {
+	v, ok := u.Claims[name]
+	return v, ok
+}
+
+type vouchClaims struct {
+	jwt.RegisteredClaims
+	Username string            `json:"username"`
+	Email    string            `json:"email"`
+	Groups   []string          `json:"groups,omitempty"`
+	Claims   map[string]string `json:"claims,omitempty"`
+}
+
+// CreateUserTokenString mints the vouch session JWT for user, signed with
+// vouch.jwt.secret and valid for vouch.jwt.maxAge minutes. It reads the
+// live config through cfg.Current() since it's called from the
+// request-serving path and must not observe a reload's in-progress
+// shadow config.
+func CreateUserTokenString(user User) (string, error) {
+	jwtCfg := cfg.Current().JWT
+	now := time.Now()
+	claims := vouchClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.Sub,
+			Issuer:    jwtCfg.Issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(jwtCfg.MaxAge) * time.Minute)),
+		},
+		Username: user.Username,
+		Email:    user.Email,
+		Groups:   user.Groups,
+		Claims:   user.Claims,
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(jwtCfg.Secret))
+}
+
+// ParseTokenString verifies tokenString against vouch.jwt.secret, falling
+// back to vouch.jwt.previousSecret so a signing key rotation has a grace
+// window rather than invalidating every outstanding session at once.
+func ParseTokenString(tokenString string) (*User, error) {
+	jwtCfg := cfg.Current().JWT
+	claims, err := parseWithSecret(tokenString, jwtCfg.Secret)
+	if err != nil && jwtCfg.PreviousSecret != "" {
+		claims, err = parseWithSecret(tokenString, jwtCfg.PreviousSecret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &User{
+		Username: claims.Username,
+		Email:    claims.Email,
+		Sub:      claims.Subject,
+		Groups:   claims.Groups,
+		Claims:   claims.Claims,
+	}, nil
+}
+
+func parseWithSecret(tokenString, secret string) (*vouchClaims, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("jwtmanager: no signing secret configured")
+	}
+	claims := &vouchClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("jwtmanager: invalid token")
+	}
+	return claims, nil
+}
+
+// ParseTokenClaims populates u from an IdP-issued ID token's claims (eg
+// from the device flow token exchange). The token's signature was already
+// validated over TLS by the IdP's token endpoint response, so this only
+// decodes the claim set rather than re-verifying it.
+func (u *User) ParseTokenClaims(idToken string) error {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(idToken, claims); err != nil {
+		return fmt.Errorf("jwtmanager: parsing id_token claims: %w", err)
+	}
+	if sub, ok := claims["sub"].(string); ok {
+		u.Sub = sub
+	}
+	if email, ok := claims["email"].(string); ok {
+		u.Email = email
+		u.Username = email
+	}
+	return nil
+}
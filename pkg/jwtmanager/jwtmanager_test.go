@@ -0,0 +1,76 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package jwtmanager
+
+import (
+	"testing"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func setJWTSecrets(t *testing.T, secret, previousSecret string) {
+	t.Helper()
+	cfg.Cfg.JWT.MaxAge = 60
+	cfg.Cfg.JWT.Secret = secret
+	cfg.Cfg.JWT.PreviousSecret = previousSecret
+	cfg.PublishForTest()
+}
+
+func TestParseTokenStringVerifiesAgainstCurrentSecret(t *testing.T) {
+	setJWTSecrets(t, "current-secret", "")
+
+	token, err := CreateUserTokenString(User{Username: "alice"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	user, err := ParseTokenString(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if user.Username != "alice" {
+		t.Errorf("got %q, want %q", user.Username, "alice")
+	}
+}
+
+func TestParseTokenStringAcceptsPreviousSecretDuringGraceWindow(t *testing.T) {
+	setJWTSecrets(t, "old-secret", "")
+	token, err := CreateUserTokenString(User{Username: "bob"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// simulate a secret rotation: the signing secret moves to a new value,
+	// and the just-rotated-out secret becomes previousSecret.
+	setJWTSecrets(t, "new-secret", "old-secret")
+
+	user, err := ParseTokenString(token)
+	if err != nil {
+		t.Fatalf("expected token signed with previousSecret to verify, got: %s", err)
+	}
+	if user.Username != "bob" {
+		t.Errorf("got %q, want %q", user.Username, "bob")
+	}
+}
+
+func TestParseTokenStringRejectsTokenFromBeforeRotationOnceGraceWindowEnds(t *testing.T) {
+	setJWTSecrets(t, "old-secret", "")
+	token, err := CreateUserTokenString(User{Username: "carol"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the grace window has ended: previousSecret is cleared too.
+	setJWTSecrets(t, "new-secret", "")
+
+	if _, err := ParseTokenString(token); err == nil {
+		t.Fatal("expected verification to fail once previousSecret no longer matches")
+	}
+}
@@ -0,0 +1,213 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+// Package ldap implements the ldap auth backend: binding a username and
+// password against a directory, and mapping the resulting entry's
+// attributes and group membership into the same shape OAuth claims take
+// elsewhere in vouch, so downstream nginx header forwarding works
+// identically regardless of backend.
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// Config is everything a Client needs to bind and search a directory.
+// It has the same connection fields as cfg.Config.LDAP (everything but
+// Admins); callers copy them across from that block.
+type Config struct {
+	URL                string
+	BindDN             string
+	BindPassword       string
+	UserSearchBase     string
+	UserFilter         string // eg "(uid=%s)"
+	GroupSearchBase    string
+	GroupFilter        string            // eg "(member=%s)"
+	Attributes         map[string]string // vouch claim name -> ldap attribute name
+	StartTLS           bool
+	InsecureSkipVerify bool
+	CACert             string
+}
+
+// Entry is a successfully authenticated directory entry
+type Entry struct {
+	DN         string
+	Attributes map[string]string
+	Groups     []string
+}
+
+// Client binds to one directory per Config
+type Client struct {
+	cfg Config
+}
+
+// NewClient validates cfg and returns a Client; it does not connect yet
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.URL == "" || cfg.UserSearchBase == "" || cfg.UserFilter == "" {
+		return nil, fmt.Errorf("ldap: url, user_search_base and user_filter are required")
+	}
+	return &Client{cfg: cfg}, nil
+}
+
+// tlsConfig builds the *tls.Config used for both an ldaps:// dial and a
+// StartTLS upgrade, so CACert and InsecureSkipVerify apply identically
+// either way - previously only StartTLS built one at all, leaving ldaps://
+// connections fully unverified and CACert a no-op on every path.
+func (c *Client) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.cfg.InsecureSkipVerify} // nolint:gosec // operator opt-in
+	if c.cfg.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(c.cfg.CACert)) {
+			return nil, fmt.Errorf("ldap: ca_cert: no certificates found in PEM data")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func (c *Client) dial() (*goldap.Conn, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := goldap.DialURL(c.cfg.URL, goldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: dial %s: %w", c.cfg.URL, err)
+	}
+	if c.cfg.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap: starttls: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// Authenticate binds as the service account, searches for username under
+// UserSearchBase, rebinds as the found entry with password to verify the
+// credential, then (re-bound as the service account) looks up the
+// entry's groups.
+func (c *Client) Authenticate(username, password string) (*Entry, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.Bind(c.cfg.BindDN, c.cfg.BindPassword); err != nil {
+		return nil, fmt.Errorf("ldap: service account bind: %w", err)
+	}
+
+	attrs := make([]string, 0, len(c.cfg.Attributes))
+	for _, a := range c.cfg.Attributes {
+		attrs = append(attrs, a)
+	}
+
+	searchReq := goldap.NewSearchRequest(
+		c.cfg.UserSearchBase,
+		goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(c.cfg.UserFilter, goldap.EscapeFilter(username)),
+		attrs,
+		nil,
+	)
+	result, err := conn.Search(searchReq)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: user search: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, fmt.Errorf("ldap: expected 1 entry for %s, found %d", username, len(result.Entries))
+	}
+	userEntry := result.Entries[0]
+
+	// most directories treat a bind with a valid DN and an empty password
+	// as an RFC 4513 "unauthenticated bind", which succeeds without
+	// checking any credential at all - reject it before it ever reaches Bind.
+	if password == "" {
+		return nil, fmt.Errorf("ldap: invalid credentials: empty password")
+	}
+
+	if err := conn.Bind(userEntry.DN, password); err != nil {
+		return nil, fmt.Errorf("ldap: invalid credentials: %w", err)
+	}
+	// rebind as the service account for the group lookup below
+	if err := conn.Bind(c.cfg.BindDN, c.cfg.BindPassword); err != nil {
+		return nil, fmt.Errorf("ldap: service account rebind: %w", err)
+	}
+
+	entry := &Entry{
+		DN:         userEntry.DN,
+		Attributes: make(map[string]string, len(c.cfg.Attributes)),
+	}
+	for claim, attr := range c.cfg.Attributes {
+		entry.Attributes[claim] = userEntry.GetAttributeValue(attr)
+	}
+
+	if c.cfg.GroupSearchBase != "" && c.cfg.GroupFilter != "" {
+		groups, err := c.groupsFor(conn, userEntry.DN)
+		if err != nil {
+			return nil, err
+		}
+		entry.Groups = groups
+	}
+
+	return entry, nil
+}
+
+func (c *Client) groupsFor(conn *goldap.Conn, userDN string) ([]string, error) {
+	searchReq := goldap.NewSearchRequest(
+		c.cfg.GroupSearchBase,
+		goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(c.cfg.GroupFilter, goldap.EscapeFilter(userDN)),
+		[]string{"cn"},
+		nil,
+	)
+	result, err := conn.Search(searchReq)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: group search: %w", err)
+	}
+	groups := make([]string, 0, len(result.Entries))
+	for _, e := range result.Entries {
+		groups = append(groups, e.GetAttributeValue("cn"))
+	}
+	return groups, nil
+}
+
+// Ping binds as the service account and performs a 1-result
+// "(objectClass=*)" search under user_search_base, so operators can
+// validate url/bind_dn/bind_password/user_search_base without a real login
+// attempt. user_filter is not used by the search.
+func (c *Client) Ping() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.Bind(c.cfg.BindDN, c.cfg.BindPassword); err != nil {
+		return fmt.Errorf("ldap: bind: %w", err)
+	}
+
+	searchReq := goldap.NewSearchRequest(
+		c.cfg.UserSearchBase,
+		goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 1, 0, false,
+		"(objectClass=*)",
+		[]string{"dn"},
+		nil,
+	)
+	if _, err := conn.Search(searchReq); err != nil {
+		return fmt.Errorf("ldap: search: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package policy
+
+// LowerLegacy translates the historical flat WhiteList/TeamWhiteList/
+// Domains/AllowAllUsers fields into an equivalent allow-rule list, so
+// cfg's compilePolicy can treat them as sugar for vouch.policy when no
+// explicit policy block is configured. Domains becomes an email_domain
+// allow rule per domain; WhiteList becomes one email allow rule per
+// address; TeamWhiteList becomes one groups allow rule per team. allowAllUsers
+// short-circuits to a single rule matching everyone.
+func LowerLegacy(domains, whitelist, teamWhitelist []string, allowAllUsers bool) []RuleConfig {
+	if allowAllUsers {
+		return []RuleConfig{{Name: "legacy-allowAllUsers"}}
+	}
+
+	var rules []RuleConfig
+	for _, email := range whitelist {
+		rules = append(rules, RuleConfig{Name: "legacy-whitelist", Email: email})
+	}
+	for _, team := range teamWhitelist {
+		rules = append(rules, RuleConfig{Name: "legacy-teamWhitelist", Groups: []string{team}})
+	}
+	for _, domain := range domains {
+		rules = append(rules, RuleConfig{Name: "legacy-domains", EmailDomain: domain})
+	}
+	return rules
+}
@@ -0,0 +1,80 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package policy
+
+import (
+	"net"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// matcher matches a single string predicate. An empty pattern always
+// matches, so a rule that doesn't set a given field doesn't constrain it.
+type matcher struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// newStringMatcher builds a matcher for one of three syntaxes:
+//   - "" (unset): always matches
+//   - "~=<re2>": matches via regexp.MatchString against the RE2 expression
+//   - a literal or glob containing "*": matched with path.Match semantics,
+//     eg "*.example.com"
+func newStringMatcher(pattern string) (matcher, error) {
+	if pattern == "" {
+		return matcher{}, nil
+	}
+	if rx, ok := strings.CutPrefix(pattern, "~="); ok {
+		re, err := regexp.Compile(rx)
+		if err != nil {
+			return matcher{}, err
+		}
+		return matcher{pattern: pattern, re: re}, nil
+	}
+	return matcher{pattern: pattern}, nil
+}
+
+func (m matcher) match(value string) bool {
+	if m.pattern == "" {
+		return true
+	}
+	if m.re != nil {
+		return m.re.MatchString(value)
+	}
+	if strings.Contains(m.pattern, "*") {
+		ok, err := path.Match(m.pattern, value)
+		return err == nil && ok
+	}
+	return m.pattern == value
+}
+
+// cidrMatcher matches a source IP (with or without a port) against a CIDR
+type cidrMatcher struct {
+	network *net.IPNet
+}
+
+func newCIDRMatcher(cidr string) (*cidrMatcher, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	return &cidrMatcher{network: network}, nil
+}
+
+func (m *cidrMatcher) match(sourceIP string) bool {
+	host := sourceIP
+	if h, _, err := net.SplitHostPort(sourceIP); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && m.network.Contains(ip)
+}
@@ -0,0 +1,81 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package policy
+
+import "testing"
+
+func TestStringMatcherEmptyAlwaysMatches(t *testing.T) {
+	m, err := newStringMatcher("")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !m.match("anything") {
+		t.Error("empty pattern should match any value")
+	}
+}
+
+func TestStringMatcherLiteral(t *testing.T) {
+	m, err := newStringMatcher("alice@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !m.match("alice@example.com") {
+		t.Error("expected literal match")
+	}
+	if m.match("bob@example.com") {
+		t.Error("expected literal mismatch")
+	}
+}
+
+func TestStringMatcherGlob(t *testing.T) {
+	m, err := newStringMatcher("*.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !m.match("foo.example.com") {
+		t.Error("expected glob to match subdomain")
+	}
+	if m.match("example.com") {
+		t.Error("glob *.example.com should not match the bare domain")
+	}
+}
+
+func TestStringMatcherRegex(t *testing.T) {
+	m, err := newStringMatcher(`~=^[a-z]+@example\.com$`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !m.match("alice@example.com") {
+		t.Error("expected regex match")
+	}
+	if m.match("ALICE@example.com") {
+		t.Error("expected regex mismatch on case")
+	}
+}
+
+func TestStringMatcherInvalidRegex(t *testing.T) {
+	if _, err := newStringMatcher("~=("); err == nil {
+		t.Fatal("expected an error for an invalid regex")
+	}
+}
+
+func TestCIDRMatcher(t *testing.T) {
+	m, err := newCIDRMatcher("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !m.match("10.1.2.3:54321") {
+		t.Error("expected CIDR match with port stripped")
+	}
+	if m.match("192.168.1.1") {
+		t.Error("expected CIDR mismatch outside the range")
+	}
+}
@@ -0,0 +1,225 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+// Package policy implements vouch.policy: ordered allow/deny rules that
+// replace (or, as sugar, express the same thing as) the flat WhiteList,
+// TeamWhiteList, Domains and AllowAllUsers config fields.
+package policy
+
+import "fmt"
+
+// Decision is the outcome of evaluating a request against an Engine
+type Decision int
+
+const (
+	// NoMatch means no rule matched; callers should apply their own
+	// default (vouch-proxy's default is deny).
+	NoMatch Decision = iota
+	// Allow means the first matching rule was an allow rule
+	Allow
+	// Deny means the first matching rule was a deny rule
+	Deny
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	default:
+		return "no-match"
+	}
+}
+
+// RuleConfig is the raw, unmarshaled shape of one entry in vouch.policy.allow
+// or vouch.policy.deny. A rule matches only if all of its non-empty
+// predicates match (logical AND); an empty predicate is ignored.
+type RuleConfig struct {
+	Name string `mapstructure:"name"`
+
+	Email       string            `mapstructure:"email"`
+	EmailDomain string            `mapstructure:"email_domain"`
+	Sub         string            `mapstructure:"sub"`
+	Groups      []string          `mapstructure:"groups"`
+	Claims      map[string]string `mapstructure:"claims"`
+
+	Host       string `mapstructure:"host"`
+	Path       string `mapstructure:"path"`
+	Method     string `mapstructure:"method"`
+	SourceCIDR string `mapstructure:"source_cidr"`
+}
+
+// User is the subset of claim data a policy rule can match against. It is
+// satisfied by jwtmanager.User so this package has no dependency on cfg or
+// jwtmanager.
+type User interface {
+	GetEmail() string
+	GetSub() string
+	GetGroups() []string
+	GetClaim(name string) (string, bool)
+}
+
+// Request is the subset of an inbound HTTP request a policy rule can
+// match against.
+type Request struct {
+	Host     string
+	Path     string
+	Method   string
+	SourceIP string
+}
+
+// Engine is a compiled, ordered set of allow/deny rules
+type Engine struct {
+	rules []compiledRule
+}
+
+type compiledRule struct {
+	RuleConfig
+	decision Decision
+
+	email       matcher
+	emailDomain matcher
+	sub         matcher
+	host        matcher
+	path        matcher
+	method      matcher
+	claims      map[string]matcher
+	cidr        *cidrMatcher
+}
+
+// Compile builds an Engine from the allow and deny rule lists, in the
+// order vouch.policy declares them: allow rules first, then deny rules,
+// preserving each list's internal order. Evaluate stops at the first
+// match, so list order is significant.
+func Compile(allow, deny []RuleConfig) (*Engine, error) {
+	e := &Engine{}
+	for _, rc := range allow {
+		cr, err := compileRule(rc, Allow)
+		if err != nil {
+			return nil, fmt.Errorf("policy: compiling allow rule %q: %w", rc.Name, err)
+		}
+		e.rules = append(e.rules, cr)
+	}
+	for _, rc := range deny {
+		cr, err := compileRule(rc, Deny)
+		if err != nil {
+			return nil, fmt.Errorf("policy: compiling deny rule %q: %w", rc.Name, err)
+		}
+		e.rules = append(e.rules, cr)
+	}
+	return e, nil
+}
+
+func compileRule(rc RuleConfig, decision Decision) (compiledRule, error) {
+	cr := compiledRule{RuleConfig: rc, decision: decision}
+
+	var err error
+	if cr.email, err = newStringMatcher(rc.Email); err != nil {
+		return cr, err
+	}
+	if cr.emailDomain, err = newStringMatcher(rc.EmailDomain); err != nil {
+		return cr, err
+	}
+	if cr.sub, err = newStringMatcher(rc.Sub); err != nil {
+		return cr, err
+	}
+	if cr.host, err = newStringMatcher(rc.Host); err != nil {
+		return cr, err
+	}
+	if cr.path, err = newStringMatcher(rc.Path); err != nil {
+		return cr, err
+	}
+	if cr.method, err = newStringMatcher(rc.Method); err != nil {
+		return cr, err
+	}
+	if rc.SourceCIDR != "" {
+		cr.cidr, err = newCIDRMatcher(rc.SourceCIDR)
+		if err != nil {
+			return cr, err
+		}
+	}
+	if len(rc.Claims) > 0 {
+		cr.claims = make(map[string]matcher, len(rc.Claims))
+		for claim, pattern := range rc.Claims {
+			m, err := newStringMatcher(pattern)
+			if err != nil {
+				return cr, fmt.Errorf("claim %s: %w", claim, err)
+			}
+			cr.claims[claim] = m
+		}
+	}
+	return cr, nil
+}
+
+// Evaluate walks the rules in order and returns the Decision and name of
+// the first rule that matches, or (NoMatch, "") if none do.
+func (e *Engine) Evaluate(u User, r Request) (Decision, string) {
+	for _, cr := range e.rules {
+		if cr.matches(u, r) {
+			return cr.decision, cr.Name
+		}
+	}
+	return NoMatch, ""
+}
+
+func (cr *compiledRule) matches(u User, r Request) bool {
+	if !cr.email.match(u.GetEmail()) {
+		return false
+	}
+	if cr.emailDomain.pattern != "" && !cr.emailDomain.match(emailDomain(u.GetEmail())) {
+		return false
+	}
+	if !cr.sub.match(u.GetSub()) {
+		return false
+	}
+	if len(cr.Groups) > 0 && !groupsIntersect(cr.Groups, u.GetGroups()) {
+		return false
+	}
+	for claim, m := range cr.claims {
+		val, ok := u.GetClaim(claim)
+		if !ok || !m.match(val) {
+			return false
+		}
+	}
+	if !cr.host.match(r.Host) {
+		return false
+	}
+	if !cr.path.match(r.Path) {
+		return false
+	}
+	if !cr.method.match(r.Method) {
+		return false
+	}
+	if cr.cidr != nil && !cr.cidr.match(r.SourceIP) {
+		return false
+	}
+	return true
+}
+
+func emailDomain(email string) string {
+	for i := len(email) - 1; i >= 0; i-- {
+		if email[i] == '@' {
+			return email[i+1:]
+		}
+	}
+	return ""
+}
+
+func groupsIntersect(want, have []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if w == h {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package policy
+
+import "testing"
+
+type testUser struct {
+	email  string
+	sub    string
+	groups []string
+	claims map[string]string
+}
+
+func (u testUser) GetEmail() string    { return u.email }
+func (u testUser) GetSub() string      { return u.sub }
+func (u testUser) GetGroups() []string { return u.groups }
+func (u testUser) GetClaim(name string) (string, bool) {
+	v, ok := u.claims[name]
+	return v, ok
+}
+
+func TestEvaluateStopsAtFirstMatch(t *testing.T) {
+	engine, err := Compile(
+		[]RuleConfig{
+			{Name: "allow-example", EmailDomain: "example.com"},
+		},
+		[]RuleConfig{
+			{Name: "deny-bob", Email: "bob@example.com"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// bob@example.com matches the allow rule first - list order (allow
+	// before deny, and within each list, declaration order) wins even
+	// though a later deny rule would also match.
+	decision, rule := engine.Evaluate(testUser{email: "bob@example.com"}, Request{})
+	if decision != Allow || rule != "allow-example" {
+		t.Errorf("got (%s, %q), want (%s, %q)", decision, rule, Allow, "allow-example")
+	}
+}
+
+func TestEvaluateAllowWhenDenyDoesNotMatch(t *testing.T) {
+	engine, err := Compile(
+		[]RuleConfig{
+			{Name: "allow-example", EmailDomain: "example.com"},
+		},
+		[]RuleConfig{
+			{Name: "deny-bob", Email: "bob@example.com"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// carol isn't bob, so the deny rule doesn't match and the allow rule
+	// (declared first) decides.
+	decision, rule := engine.Evaluate(testUser{email: "carol@example.com"}, Request{})
+	if decision != Allow || rule != "allow-example" {
+		t.Errorf("got (%s, %q), want (%s, %q)", decision, rule, Allow, "allow-example")
+	}
+}
+
+func TestEvaluateNoMatch(t *testing.T) {
+	engine, err := Compile(
+		[]RuleConfig{{Name: "allow-example", EmailDomain: "example.com"}},
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	decision, rule := engine.Evaluate(testUser{email: "carol@other.com"}, Request{})
+	if decision != NoMatch || rule != "" {
+		t.Errorf("got (%s, %q), want (%s, %q)", decision, rule, NoMatch, "")
+	}
+}
+
+func TestEvaluateRuleFieldsAreANDed(t *testing.T) {
+	engine, err := Compile(
+		[]RuleConfig{
+			{Name: "allow-admins-on-admin-host", EmailDomain: "example.com", Host: "admin.example.com"},
+		},
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// matches EmailDomain but not Host - a rule with multiple predicates
+	// must satisfy all of them (logical AND), not just one.
+	decision, _ := engine.Evaluate(testUser{email: "alice@example.com"}, Request{Host: "other.example.com"})
+	if decision != NoMatch {
+		t.Errorf("got %s, want %s when only one of two predicates matches", decision, NoMatch)
+	}
+
+	// matches both EmailDomain and Host.
+	decision, rule := engine.Evaluate(testUser{email: "alice@example.com"}, Request{Host: "admin.example.com"})
+	if decision != Allow || rule != "allow-admins-on-admin-host" {
+		t.Errorf("got (%s, %q), want (%s, %q)", decision, rule, Allow, "allow-admins-on-admin-host")
+	}
+}
@@ -0,0 +1,37 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package secrets
+
+import "os"
+
+// FileProvider reads secrets from a single flat file on disk, preserving
+// the historical config/secret behavior (the whole file contents is the
+// secret, regardless of key).
+type FileProvider struct {
+	path string
+}
+
+// NewFileProvider returns a Provider backed by a flat file on disk
+func NewFileProvider(path string) *FileProvider {
+	return &FileProvider{path: path}
+}
+
+// Fetch returns the contents of the file, ignoring key
+func (f *FileProvider) Fetch(_ string) (string, error) {
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Close is a no-op for FileProvider
+func (f *FileProvider) Close() {}
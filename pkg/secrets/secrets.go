@@ -0,0 +1,63 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+// Package secrets abstracts where vouch.jwt.secret, vouch.session.key and
+// oauth.client_secret come from, so that the on-disk config/secret file is
+// just one Provider among others (eg HashiCorp Vault).
+package secrets
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Provider fetches a single named secret from a backend
+type Provider interface {
+	// Fetch returns the current value for key, or an error if it cannot be read
+	Fetch(key string) (string, error)
+
+	// Close stops any background renewal and releases backend resources
+	Close()
+}
+
+// RenewableProvider is implemented by backends that hold a leased secret
+// (eg a Vault KV lease) which can expire and must be periodically renewed
+// or re-read.
+type RenewableProvider interface {
+	Provider
+
+	// Renew re-fetches or renews the underlying lease. It is safe to call
+	// on a schedule; callers should treat a returned error as "keep using
+	// the last known good value" rather than fatal.
+	Renew() error
+}
+
+// ErrSecretNotFound is returned by a Provider when key has no value
+var ErrSecretNotFound = errors.New("secrets: key not found")
+
+// NewProvider builds the configured Provider from a secrets config block.
+// backend is one of "file" (the default, preserving the historical
+// config/secret behavior) or "vault".
+func NewProvider(backend string, opt Options) (Provider, error) {
+	switch backend {
+	case "", "file":
+		return NewFileProvider(opt.FilePath), nil
+	case "vault":
+		return NewVaultProvider(opt.Vault)
+	default:
+		return nil, fmt.Errorf("secrets: unknown backend %q", backend)
+	}
+}
+
+// Options groups the config needed to construct any Provider
+type Options struct {
+	FilePath string
+	Vault    VaultOptions
+}
@@ -0,0 +1,255 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package secrets
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"go.uber.org/zap"
+)
+
+var log *zap.SugaredLogger
+
+// SetLogger lets cfg hand the already-configured Vouch logger down to this
+// package, rather than each package standing up its own zap instance.
+func SetLogger(l *zap.SugaredLogger) {
+	log = l
+}
+
+// VaultAuth describes how to authenticate to Vault
+type VaultAuth struct {
+	Method string // token | approle | kubernetes
+
+	// Method: token
+	Token string
+
+	// Method: approle
+	RoleID   string
+	SecretID string
+
+	// Method: kubernetes
+	Role       string
+	JWTPath    string // defaults to /var/run/secrets/kubernetes.io/serviceaccount/token
+	LoginMount string // defaults to "kubernetes"
+}
+
+// VaultOptions configures VaultProvider
+type VaultOptions struct {
+	Address   string
+	Namespace string
+	Mount     string // the KV mount, eg "secret"
+	Path      string // the path within the mount, eg "vouch-proxy/config"
+	Auth      VaultAuth
+
+	// RenewInterval controls how often Renew is invoked by the background
+	// goroutine. Zero disables automatic renewal.
+	RenewInterval time.Duration
+
+	// KVVersion is 1 or 2. Zero (the default) auto-detects the mount's KV
+	// version from Vault's sys/internal/ui/mounts API at startup, since a
+	// v1 mount has no `data/` sub-path and a v2 read against a v1 mount
+	// 404s.
+	KVVersion int
+}
+
+// VaultProvider fetches secrets out of a HashiCorp Vault KV (v1 or v2)
+// secret engine, re-reading it (and renewing its own token's lease, when
+// leased) on a timer; Fetch returns values from the latest successful
+// read. Values a caller already fetched are not updated by these re-reads.
+type VaultProvider struct {
+	opt       VaultOptions
+	client    *vaultapi.Client
+	kvVersion int
+
+	mu     sync.RWMutex
+	kv     map[string]interface{}
+	stopCh chan struct{}
+}
+
+// NewVaultProvider logs into Vault per opt.Auth, performs an initial
+// read of opt.Path, and (if opt.RenewInterval is set) starts a background
+// goroutine to keep the lease and the cached values fresh.
+func NewVaultProvider(opt VaultOptions) (*VaultProvider, error) {
+	cfg := vaultapi.DefaultConfig()
+	cfg.Address = opt.Address
+	client, err := vaultapi.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: vault client: %w", err)
+	}
+	if opt.Namespace != "" {
+		client.SetNamespace(opt.Namespace)
+	}
+
+	v := &VaultProvider{
+		opt:       opt,
+		client:    client,
+		kvVersion: opt.KVVersion,
+		stopCh:    make(chan struct{}),
+	}
+
+	if err := v.login(); err != nil {
+		return nil, err
+	}
+	if v.kvVersion == 0 {
+		v.kvVersion, err = v.detectKVVersion()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := v.Renew(); err != nil {
+		return nil, err
+	}
+
+	if opt.RenewInterval > 0 {
+		go v.renewLoop()
+	}
+	return v, nil
+}
+
+func (v *VaultProvider) login() error {
+	switch v.opt.Auth.Method {
+	case "", "token":
+		v.client.SetToken(v.opt.Auth.Token)
+		return nil
+	case "approle":
+		secret, err := v.client.Logical().Write("auth/approle/login", map[string]interface{}{
+			"role_id":   v.opt.Auth.RoleID,
+			"secret_id": v.opt.Auth.SecretID,
+		})
+		if err != nil {
+			return fmt.Errorf("secrets: vault approle login: %w", err)
+		}
+		v.client.SetToken(secret.Auth.ClientToken)
+		return nil
+	case "kubernetes":
+		jwtPath := v.opt.Auth.JWTPath
+		if jwtPath == "" {
+			jwtPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+		}
+		mount := v.opt.Auth.LoginMount
+		if mount == "" {
+			mount = "kubernetes"
+		}
+		jwt, err := readFile(jwtPath)
+		if err != nil {
+			return fmt.Errorf("secrets: reading kubernetes service account token: %w", err)
+		}
+		secret, err := v.client.Logical().Write("auth/"+mount+"/login", map[string]interface{}{
+			"role": v.opt.Auth.Role,
+			"jwt":  jwt,
+		})
+		if err != nil {
+			return fmt.Errorf("secrets: vault kubernetes login: %w", err)
+		}
+		v.client.SetToken(secret.Auth.ClientToken)
+		return nil
+	default:
+		return fmt.Errorf("secrets: unknown vault auth method %q", v.opt.Auth.Method)
+	}
+}
+
+// detectKVVersion asks Vault's mount-introspection API which KV version
+// opt.Mount runs, so callers don't have to configure it by hand.
+func (v *VaultProvider) detectKVVersion() (int, error) {
+	secret, err := v.client.Logical().Read("sys/internal/ui/mounts/" + v.opt.Mount)
+	if err != nil {
+		return 0, fmt.Errorf("secrets: detecting KV version of mount %s: %w", v.opt.Mount, err)
+	}
+	if secret != nil {
+		if options, ok := secret.Data["options"].(map[string]interface{}); ok {
+			if version, ok := options["version"].(string); ok && version == "2" {
+				return 2, nil
+			}
+		}
+	}
+	// mounts with no version option (or that 404 the introspection
+	// endpoint entirely, eg on very old Vault versions) are KV v1
+	return 1, nil
+}
+
+// Renew re-reads the configured KV path and renews the current token's
+// lease. Errors are non-fatal to callers that already have a cached
+// value: they should keep serving the stale secret and log the failure.
+func (v *VaultProvider) Renew() error {
+	secret, err := v.client.Logical().Read(v.kvReadPath())
+	if err != nil {
+		return fmt.Errorf("secrets: vault read %s: %w", v.opt.Path, err)
+	}
+	if secret == nil {
+		return fmt.Errorf("secrets: vault path %s returned no data", v.opt.Path)
+	}
+
+	data := secret.Data
+	if v.kvVersion == 2 {
+		// KV v2 nests the actual fields under "data"
+		nested, ok := secret.Data["data"].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("secrets: vault path %s missing KV v2 \"data\" field", v.opt.Path)
+		}
+		data = nested
+	}
+
+	v.mu.Lock()
+	v.kv = data
+	v.mu.Unlock()
+
+	if _, err := v.client.Auth().Token().RenewSelf(0); err != nil && log != nil {
+		log.Debugf("secrets: vault token renewal skipped: %s", err)
+	}
+	return nil
+}
+
+// kvReadPath builds the mount-relative read path for the configured KV
+// version: "mount/data/path" for v2, plain "mount/path" for v1.
+func (v *VaultProvider) kvReadPath() string {
+	if v.kvVersion == 2 {
+		return v.opt.Mount + "/data/" + v.opt.Path
+	}
+	return v.opt.Mount + "/" + v.opt.Path
+}
+
+func (v *VaultProvider) renewLoop() {
+	ticker := time.NewTicker(v.opt.RenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := v.Renew(); err != nil && log != nil {
+				log.Errorf("secrets: vault renew failed, keeping last known value: %s", err)
+			}
+		case <-v.stopCh:
+			return
+		}
+	}
+}
+
+// Fetch returns the string value of key out of the last successful read
+func (v *VaultProvider) Fetch(key string) (string, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	val, ok := v.kv[key]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	s, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("secrets: vault key %s is not a string", key)
+	}
+	return s, nil
+}
+
+// Close stops the background renewal goroutine
+func (v *VaultProvider) Close() {
+	close(v.stopCh)
+}